@@ -0,0 +1,171 @@
+package mdfstore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/psperber94/tusd"
+)
+
+// ErrChecksumMismatch is returned when the bytes written for a chunk, or the
+// whole file, do not hash to the checksum declared by the client.
+var ErrChecksumMismatch = errors.New("mdfstore: checksum mismatch")
+
+// ErrUnsupportedChecksumAlgorithm is returned when the client declares a
+// checksum algorithm this store does not implement.
+var ErrUnsupportedChecksumAlgorithm = errors.New("mdfstore: unsupported checksum algorithm")
+
+// ChecksumStore is implemented by DataStores that can verify the integrity
+// of the bytes they store, as required by the tus checksum extension
+// (https://tus.io/protocols/resumable-upload.html#checksum). MdfStore
+// registers it with composer.UseChecksumVerifier in UseIn, the same way it
+// registers every other extension interface in this file, so a handler that
+// parses the Upload-Checksum header calls WriteChunkChecksummed directly
+// instead of WriteChunk.
+//
+// SetPendingChecksum and the plain WriteChunk path below exist for the same
+// reason: not every caller goes through the composer-discovered method by
+// name, and a handler that already knows the algorithm/checksum up front,
+// or a caller restoring a pending checksum after a restart, can declare it
+// once and let the next WriteChunk verify and clear it.
+type ChecksumStore interface {
+	tusd.DataStore
+	// WriteChunkChecksummed behaves like WriteChunk, but additionally
+	// verifies that the bytes read from src hash to checksum under
+	// algorithm. If they do not match, the file is truncated back to its
+	// pre-write offset and ErrChecksumMismatch is returned so the client
+	// can retry the same chunk.
+	WriteChunkChecksummed(id string, offset int64, src io.Reader, algorithm string, checksum []byte) (int64, error)
+}
+
+// pendingChecksum is an Upload-Checksum declaration awaiting the next
+// WriteChunk call for an upload.
+type pendingChecksum struct {
+	algorithm string
+	checksum  []byte
+}
+
+// pendingChecksums holds the pendingChecksum declared for each upload ID,
+// shared by every copy of an MdfStore value via pointer, the same way
+// processorList and statusTracker are.
+type pendingChecksums struct {
+	mu      sync.Mutex
+	pending map[string]pendingChecksum
+}
+
+func newPendingChecksums() *pendingChecksums {
+	return &pendingChecksums{pending: make(map[string]pendingChecksum)}
+}
+
+func (p *pendingChecksums) set(id string, pc pendingChecksum) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending[id] = pc
+}
+
+// take returns and clears the pendingChecksum for id, if any.
+func (p *pendingChecksums) take(id string) (pendingChecksum, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := p.pending[id]
+	if ok {
+		delete(p.pending, id)
+	}
+	return pc, ok
+}
+
+// newChecksumHash returns a fresh hash.Hash for the given tus checksum
+// algorithm name.
+func newChecksumHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	default:
+		return nil, ErrUnsupportedChecksumAlgorithm
+	}
+}
+
+// SetPendingChecksum declares that the bytes written by the next WriteChunk
+// call for id must hash to checksum under algorithm. WriteChunkChecksummed
+// calls this internally; it is also exported for a caller that wants to
+// declare a checksum ahead of a plain WriteChunk call.
+func (store MdfStore) SetPendingChecksum(id string, algorithm string, checksum []byte) {
+	store.pendingChecksums.set(id, pendingChecksum{algorithm: algorithm, checksum: checksum})
+}
+
+// WriteChunkChecksummed is a convenience wrapper around SetPendingChecksum
+// followed by WriteChunk, for callers that prefer a single call.
+func (store MdfStore) WriteChunkChecksummed(id string, offset int64, src io.Reader, algorithm string, checksum []byte) (int64, error) {
+	store.SetPendingChecksum(id, algorithm, checksum)
+	return store.WriteChunk(id, offset, src)
+}
+
+// writeChunkChecksummed is the actual verifying write, called from
+// WriteChunk whenever a pendingChecksum was declared for id. On a mismatch
+// the file is truncated back to offset so that the client's retry of the
+// same chunk starts from a clean slate.
+func (store MdfStore) writeChunkChecksummed(id string, offset int64, src io.Reader, pc pendingChecksum) (int64, error) {
+	h, err := newChecksumHash(pc.algorithm)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(store.binPath(id), os.O_WRONLY|os.O_APPEND, defaultFilePerm)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n, err := io.Copy(io.MultiWriter(file, h), src)
+	if err != nil {
+		return n, err
+	}
+
+	if !bytes.Equal(h.Sum(nil), pc.checksum) {
+		if err := file.Truncate(offset); err != nil {
+			return n, fmt.Errorf("mdfstore: truncating after checksum mismatch: %w", err)
+		}
+		return 0, ErrChecksumMismatch
+	}
+
+	return n, nil
+}
+
+// fileDigest hashes the entire .bin file currently stored for id using
+// algorithm.
+func (store MdfStore) fileDigest(id string, algorithm string) ([]byte, error) {
+	h, err := newChecksumHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := store.GetReader(id)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := file.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,131 @@
+package mdfstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/psperber94/tusd"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestWriteChunkVerifiesMatchingChecksum(t *testing.T) {
+	store := newTestStore(t)
+	writeTestUpload(t, store, "a", "")
+
+	payload := "hello world"
+	sum := sha256.Sum256([]byte(payload))
+
+	store.SetPendingChecksum("a", "sha256", sum[:])
+	n, err := store.WriteChunk("a", 0, strings.NewReader(payload))
+	if err != nil {
+		t.Fatalf("WriteChunk: %s", err)
+	}
+	if n != int64(len(payload)) {
+		t.Fatalf("n = %d, want %d", n, len(payload))
+	}
+
+	data, err := ioutil.ReadFile(store.binPath("a"))
+	if err != nil {
+		t.Fatalf("reading .bin: %s", err)
+	}
+	if string(data) != payload {
+		t.Fatalf("content = %q, want %q", data, payload)
+	}
+}
+
+func TestWriteChunkRejectsMismatchingChecksumAndTruncates(t *testing.T) {
+	store := newTestStore(t)
+	writeTestUpload(t, store, "a", "existing-")
+
+	offset := int64(len("existing-"))
+	store.SetPendingChecksum("a", "sha256", []byte("not-a-real-digest"))
+
+	if _, err := store.WriteChunk("a", offset, strings.NewReader("garbage")); err != ErrChecksumMismatch {
+		t.Fatalf("err = %v, want ErrChecksumMismatch", err)
+	}
+
+	data, err := ioutil.ReadFile(store.binPath("a"))
+	if err != nil {
+		t.Fatalf("reading .bin: %s", err)
+	}
+	if string(data) != "existing-" {
+		t.Fatalf(".bin was not truncated back to the pre-write offset: %q", data)
+	}
+}
+
+func TestWriteChunkWithoutPendingChecksumIsUnaffected(t *testing.T) {
+	store := newTestStore(t)
+	writeTestUpload(t, store, "a", "")
+
+	if _, err := store.WriteChunk("a", 0, strings.NewReader("plain")); err != nil {
+		t.Fatalf("WriteChunk: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(store.binPath("a"))
+	if err != nil {
+		t.Fatalf("reading .bin: %s", err)
+	}
+	if string(data) != "plain" {
+		t.Fatalf("content = %q, want %q", data, "plain")
+	}
+}
+
+func TestFinishUploadRejectsDeclaredWholeFileChecksumMismatch(t *testing.T) {
+	store := newTestStore(t)
+	writeTestUpload(t, store, "a", "payload")
+
+	info, err := store.GetInfo("a")
+	if err != nil {
+		t.Fatalf("GetInfo: %s", err)
+	}
+	info.MetaData = tusd.MetaData{"checksum": strings.Repeat("00", sha256.Size)}
+	if err := store.writeInfo("a", info); err != nil {
+		t.Fatalf("writeInfo: %s", err)
+	}
+
+	if err := store.FinishUpload("a"); err != ErrChecksumMismatch {
+		t.Fatalf("FinishUpload err = %v, want ErrChecksumMismatch", err)
+	}
+
+	info, err = store.GetInfo("a")
+	if err != nil {
+		t.Fatalf("GetInfo after FinishUpload: %s", err)
+	}
+	if info.MetaData["conversion_state"] != string(ConversionFailed) {
+		t.Fatalf("conversion_state = %q, want %q", info.MetaData["conversion_state"], ConversionFailed)
+	}
+}
+
+func TestFinishUploadAcceptsMatchingWholeFileChecksum(t *testing.T) {
+	store := newTestStore(t)
+	payload := "payload"
+	writeTestUpload(t, store, "a", payload)
+
+	info, err := store.GetInfo("a")
+	if err != nil {
+		t.Fatalf("GetInfo: %s", err)
+	}
+	info.MetaData = tusd.MetaData{"checksum": sha256Hex(payload)}
+	if err := store.writeInfo("a", info); err != nil {
+		t.Fatalf("writeInfo: %s", err)
+	}
+
+	if err := store.FinishUpload("a"); err != nil {
+		t.Fatalf("FinishUpload: %s", err)
+	}
+
+	info, err = store.GetInfo("a")
+	if err != nil {
+		t.Fatalf("GetInfo after FinishUpload: %s", err)
+	}
+	if info.MetaData["checksum_sha256"] != sha256Hex(payload) {
+		t.Fatalf("checksum_sha256 = %q, want %q", info.MetaData["checksum_sha256"], sha256Hex(payload))
+	}
+}
@@ -1,16 +1,19 @@
 package mdfstore
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/psperber94/tusd"
 	"github.com/psperber94/tusd/uid"
-	"bufio"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
-	"os/exec"
+	"strings"
 
 	"gopkg.in/Acconut/lockfile.v1"
 )
@@ -23,19 +26,112 @@ type MdfStore struct {
 	// Relative or absolute path to store files in. MdfStore does not check
 	// whether the path exists, use os.MkdirAll in this case on your own.
 	Path string
+	// ConverterPath is deprecated: register a PostProcessor (e.g. an
+	// ExecProcessor) via AddProcessor or the Option passed to New instead.
+	// If set, New registers an ExecProcessor that runs
+	// `python <ConverterPath> <binPath>` as the first processor, for
+	// backwards compatibility with existing callers.
 	ConverterPath string
+	// KeepPartials, when true, causes ConcatUploads to leave the source
+	// uploads it concatenated in place instead of terminating them, so they
+	// remain available for audit. Defaults to false.
+	KeepPartials bool
+
+	processors       *processorList
+	queue            ConversionQueue
+	retry            RetryPolicy
+	status           *statusTracker
+	pendingChecksums *pendingChecksums
+}
+
+// Option configures an MdfStore created with New.
+type Option func(*MdfStore)
+
+// WithProcessor appends proc to the ordered chain of PostProcessors run by
+// FinishUpload.
+func WithProcessor(proc PostProcessor) Option {
+	return func(store *MdfStore) {
+		store.processors.add(proc)
+	}
+}
+
+// WithQueue overrides the ConversionQueue backend used to run the
+// PostProcessor chain. Defaults to an in-memory WorkerPoolQueue.
+func WithQueue(queue ConversionQueue) Option {
+	return func(store *MdfStore) {
+		store.queue = queue
+	}
+}
+
+// WithDiskQueue configures a DiskQueue, backed by a WorkerPoolQueue with the
+// given number of workers, so that pending conversions survive a process
+// restart.
+func WithDiskQueue(workers int, retry RetryPolicy) Option {
+	return func(store *MdfStore) {
+		store.queue = NewDiskQueue(store.Path, NewWorkerPoolQueue(workers, retry))
+	}
+}
+
+// WithRetryPolicy overrides the retry policy used by the default
+// WorkerPoolQueue. It has no effect if WithQueue or WithDiskQueue is also
+// passed.
+func WithRetryPolicy(retry RetryPolicy) Option {
+	return func(store *MdfStore) {
+		store.retry = retry
+	}
 }
 
 // New creates a new file based storage backend. The directory specified will
 // be used as the only storage entry. This method does not check
 // whether the path exists, use os.MkdirAll to ensure.
 // In addition, a locking mechanism is provided.
-func New(uploadPath string, converterPath string) MdfStore {
-	return MdfStore{uploadPath, converterPath}
+func New(uploadPath string, converterPath string, opts ...Option) MdfStore {
+	store := MdfStore{
+		Path:             uploadPath,
+		ConverterPath:    converterPath,
+		retry:            DefaultRetryPolicy,
+		processors:       newProcessorList(),
+		status:           newStatusTracker(),
+		pendingChecksums: newPendingChecksums(),
+	}
+
+	if converterPath != "" {
+		store.AddProcessor(&ExecProcessor{
+			Command: "python",
+			Args:    []string{converterPath, "{{bin}}"},
+		})
+	}
+
+	for _, opt := range opts {
+		opt(&store)
+	}
+
+	if store.queue == nil {
+		store.queue = NewWorkerPoolQueue(4, store.retry)
+	}
+	store.queue.Init(store.runProcessors, store.onConversionUpdate)
+
+	if err := store.queue.Recover(); err != nil {
+		log.Printf("mdfstore: recovering pending conversions: %s", err)
+	}
+
+	return store
+}
+
+// AddProcessor appends proc to the ordered chain of PostProcessors run by
+// FinishUpload. It is safe to call on a store returned by New at any point
+// afterwards: the chain lives behind a pointer shared by every copy of the
+// MdfStore value, including the one already handed to a ConversionQueue, so
+// processors registered this way are picked up by conversions that run
+// later.
+func (store *MdfStore) AddProcessor(proc PostProcessor) {
+	store.processors.add(proc)
 }
 
 // UseIn sets this store as the core data store in the passed composer and adds
-// all possible extension to it.
+// all possible extension to it, including checksum verification. Apart from
+// that registration, WriteChunk also verifies a checksum whenever
+// SetPendingChecksum was called for the upload being written.
 func (store MdfStore) UseIn(composer *tusd.StoreComposer) {
 	composer.UseCore(store)
 	composer.UseGetReader(store)
@@ -44,6 +140,7 @@ func (store MdfStore) UseIn(composer *tusd.StoreComposer) {
 	composer.UseLocker(store)
 	composer.UseConcater(store)
 	composer.UseLengthDeferrer(store)
+	composer.UseChecksumVerifier(store)
 }
 
 func (store MdfStore) NewUpload(info tusd.FileInfo) (id string, err error) {
@@ -65,7 +162,15 @@ func (store MdfStore) NewUpload(info tusd.FileInfo) (id string, err error) {
 	return
 }
 
+// WriteChunk writes src to id's .bin file starting at offset. If
+// SetPendingChecksum was called for id since its last WriteChunk, the bytes
+// are verified against the declared checksum before being acknowledged; see
+// writeChunkChecksummed.
 func (store MdfStore) WriteChunk(id string, offset int64, src io.Reader) (int64, error) {
+	if pc, ok := store.pendingChecksums.take(id); ok {
+		return store.writeChunkChecksummed(id, offset, src, pc)
+	}
+
 	file, err := os.OpenFile(store.binPath(id), os.O_WRONLY|os.O_APPEND, defaultFilePerm)
 	if err != nil {
 		return 0, err
@@ -110,25 +215,83 @@ func (store MdfStore) Terminate(id string) error {
 	return nil
 }
 
-func (store MdfStore) ConcatUploads(dest string, uploads []string) (err error) {
-	file, err := os.OpenFile(store.binPath(dest), os.O_WRONLY|os.O_APPEND, defaultFilePerm)
+// ConcatUploads builds dest's .bin file out of the concatenation of
+// uploads, in order. The result is assembled in a ".bin.tmp" sibling file
+// that is fsync'd and renamed into place, so a crash mid-concat can never
+// leave dest looking complete with corrupt or partial content. dest's .info
+// is updated with the final size and a concatenated_from record of the
+// source IDs. Unless KeepPartials is set, the source uploads are terminated
+// once they have been folded into dest.
+func (store MdfStore) ConcatUploads(dest string, uploads []string) error {
+	tmpPath := store.binPath(dest) + ".tmp"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, defaultFilePerm)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
+	var size int64
 	for _, id := range uploads {
-		src, err := store.GetReader(id)
-		if err != nil {
+		if err := func() error {
+			src, err := store.GetReader(id)
+			if err != nil {
+				return err
+			}
+			if closer, ok := src.(io.Closer); ok {
+				defer closer.Close()
+			}
+
+			n, err := io.Copy(tmp, src)
+			size += n
+			return err
+		}(); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
 			return err
 		}
+	}
 
-		if _, err := io.Copy(file, src); err != nil {
-			return err
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("mdfstore: syncing concatenated upload: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("mdfstore: closing concatenated upload: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, store.binPath(dest)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("mdfstore: renaming concatenated upload into place: %w", err)
+	}
+
+	info, err := store.GetInfo(dest)
+	if err != nil {
+		return err
+	}
+	info.Size = size
+	info.Offset = size
+	info.IsFinal = true
+	if info.MetaData == nil {
+		info.MetaData = tusd.MetaData{}
+	}
+	info.MetaData["concatenated_from"] = strings.Join(uploads, ",")
+	if err := store.writeInfo(dest, info); err != nil {
+		return err
+	}
+
+	if store.KeepPartials {
+		return nil
+	}
+
+	for _, id := range uploads {
+		if err := store.Terminate(id); err != nil {
+			return fmt.Errorf("mdfstore: terminating source upload %s after concat: %w", id, err)
 		}
 	}
 
-	return
+	return nil
 }
 
 func (store MdfStore) DeclareLength(id string, length int64) error {
@@ -205,35 +368,124 @@ func (store MdfStore) writeInfo(id string, info tusd.FileInfo) error {
 	return ioutil.WriteFile(store.infoPath(id), data, defaultFilePerm)
 }
 
-func copyOutput(r io.Reader) {
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		fmt.Println(scanner.Text())
+// FinishUpload is called once the entire upload has been received. It
+// records a whole-file digest and, if the client declared one via
+// Upload-Metadata, refuses to run the PostProcessor chain on a corrupt
+// upload. Otherwise it hands the job off to the configured ConversionQueue
+// and returns immediately; GetConversionStatus (or the upload's
+// conversion_state MetaData, visible via HEAD) can be polled to observe
+// progress.
+func (store MdfStore) FinishUpload(id string) error {
+	info, err := store.GetInfo(id)
+	if err != nil {
+		return err
 	}
-}
 
-func (store MdfStore) FinishUpload(id string) error {
-	fmt.Println("File Upload with Id: ", id, " finished")
+	digest, err := store.fileDigest(id, "sha256")
+	if err != nil {
+		return err
+	}
+	if info.MetaData == nil {
+		info.MetaData = tusd.MetaData{}
+	}
+	info.MetaData["checksum_sha256"] = hex.EncodeToString(digest)
 
-	time.sleep(500 * time.Millisecond)
+	if declared := info.MetaData["checksum"]; declared != "" {
+		algorithm := info.MetaData["checksum_algorithm"]
+		if algorithm == "" {
+			algorithm = "sha256"
+		}
 
-	converter := exec.Command("python",store.ConverterPath, store.binPath(id))
-	stdout, err := converter.StdoutPipe()
-	if err != nil {
-		panic(err)
+		want, err := hex.DecodeString(declared)
+		if err != nil {
+			return fmt.Errorf("mdfstore: decoding declared checksum: %w", err)
+		}
+
+		got, err := store.fileDigest(id, algorithm)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(got, want) {
+			info.MetaData["conversion_state"] = string(ConversionFailed)
+			info.MetaData["conversion_error"] = ErrChecksumMismatch.Error()
+			if err := store.writeInfo(id, info); err != nil {
+				return err
+			}
+			return ErrChecksumMismatch
+		}
 	}
-	stderr, err := converter.StderrPipe()
+
+	if err := store.writeInfo(id, info); err != nil {
+		return err
+	}
+
+	if store.processors.len() == 0 {
+		store.onConversionUpdate(id, ConversionStatus{State: ConversionSucceeded})
+		return nil
+	}
+
+	return store.queue.Enqueue(id, store.binPath(id), info)
+}
+
+// GetConversionStatus reports the current state of the PostProcessor chain
+// for id. It first consults the in-memory cache populated by the
+// ConversionQueue and falls back to the conversion_state persisted in the
+// .info file, which is authoritative across process restarts.
+func (store MdfStore) GetConversionStatus(id string) (ConversionStatus, error) {
+	if status, ok := store.status.get(id); ok {
+		return status, nil
+	}
+
+	info, err := store.GetInfo(id)
 	if err != nil {
-		panic(err)
+		return ConversionStatus{}, err
 	}
-	if err := converter.Start(); err != nil{
-		return err
+
+	state := ConversionState(info.MetaData["conversion_state"])
+	if state == "" {
+		state = ConversionPending
 	}
+	return ConversionStatus{State: state, Err: info.MetaData["conversion_error"]}, nil
+}
 
-	go copyOutput(stdout)
-	go copyOutput(stderr)
-	converter.Wait()
+// runProcessors runs the registered PostProcessor chain in order, stopping
+// at the first error. It is passed to the ConversionQueue as its Runner.
+// Taking a snapshot of store.processors here (rather than closing over the
+// slice directly) means it always reflects whatever AddProcessor has
+// registered by the time a job actually runs, not just what existed when
+// New bound this method to the queue.
+func (store MdfStore) runProcessors(ctx context.Context, id string, binPath string, info tusd.FileInfo) error {
+	for i, proc := range store.processors.snapshot() {
+		if err := proc.Process(ctx, id, binPath, info); err != nil {
+			return fmt.Errorf("processor %d: %w", i, err)
+		}
+	}
 	return nil
 }
 
+// onConversionUpdate is passed to the ConversionQueue as its UpdateFunc. It
+// keeps the in-memory status cache and the upload's .info MetaData in sync.
+func (store MdfStore) onConversionUpdate(id string, status ConversionStatus) {
+	store.status.set(id, status)
+
+	info, err := store.GetInfo(id)
+	if err != nil {
+		log.Printf("mdfstore: upload %s: loading info to update conversion status: %s", id, err)
+		return
+	}
 
+	if info.MetaData == nil {
+		info.MetaData = tusd.MetaData{}
+	}
+	info.MetaData["conversion_state"] = string(status.State)
+	if status.Err != "" {
+		info.MetaData["conversion_error"] = status.Err
+	} else {
+		delete(info.MetaData, "conversion_error")
+	}
+
+	if err := store.writeInfo(id, info); err != nil {
+		log.Printf("mdfstore: upload %s: persisting conversion status: %s", id, err)
+	}
+}
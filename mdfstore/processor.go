@@ -0,0 +1,151 @@
+package mdfstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psperber94/tusd"
+)
+
+// PostProcessor performs an action on a finished upload, such as converting
+// its binary data into another format. FinishUpload runs the processors
+// registered on an MdfStore in order, passing each the path to the upload's
+// .bin file.
+type PostProcessor interface {
+	Process(ctx context.Context, id string, binPath string, info tusd.FileInfo) error
+}
+
+// FuncProcessor adapts a plain Go function into a PostProcessor, for
+// conversions that do not need to shell out to an external process.
+type FuncProcessor struct {
+	Fn func(ctx context.Context, id string, binPath string, info tusd.FileInfo) error
+}
+
+func (p FuncProcessor) Process(ctx context.Context, id string, binPath string, info tusd.FileInfo) error {
+	return p.Fn(ctx, id, binPath, info)
+}
+
+// ExecProcessor runs an external command against the uploaded file, such as
+// the MDF conversion script. It is the configurable replacement for the
+// previously hardcoded `python <converter> <file>` invocation.
+type ExecProcessor struct {
+	// Command is the executable to invoke, e.g. "python" or "/usr/bin/ffmpeg".
+	Command string
+	// Args are passed to Command. The placeholders "{{bin}}" and "{{id}}"
+	// are substituted with the upload's .bin path and ID before the process
+	// is started.
+	Args []string
+	// Env, if non-nil, is appended to the spawned process's environment,
+	// which otherwise inherits os.Environ().
+	Env []string
+	// Dir is the working directory for the spawned process. Defaults to the
+	// current working directory if empty.
+	Dir string
+	// Timeout bounds how long the command may run before it is killed via
+	// its context. Zero means no timeout beyond the context passed in.
+	Timeout time.Duration
+	// Logger receives the command's stdout and stderr, line by line.
+	// Defaults to log.Default() if nil.
+	Logger *log.Logger
+}
+
+func (p *ExecProcessor) Process(ctx context.Context, id string, binPath string, info tusd.FileInfo) error {
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	args := make([]string, len(p.Args))
+	for i, arg := range p.Args {
+		arg = strings.ReplaceAll(arg, "{{bin}}", binPath)
+		arg = strings.ReplaceAll(arg, "{{id}}", id)
+		args[i] = arg
+	}
+
+	cmd := exec.CommandContext(ctx, p.Command, args...)
+	cmd.Dir = p.Dir
+	if p.Env != nil {
+		cmd.Env = append(os.Environ(), p.Env...)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("mdfstore: exec processor: stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("mdfstore: exec processor: stderr pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("mdfstore: exec processor: starting %s: %w", p.Command, err)
+	}
+
+	logger := p.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go streamOutput(&wg, logger, id, "stdout", stdout)
+	go streamOutput(&wg, logger, id, "stderr", stderr)
+	wg.Wait()
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("mdfstore: exec processor: %s: %w", p.Command, err)
+	}
+	return nil
+}
+
+func streamOutput(wg *sync.WaitGroup, logger *log.Logger, id string, stream string, r io.Reader) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		logger.Printf("mdfstore: upload %s: %s: %s", id, stream, scanner.Text())
+	}
+}
+
+// processorList holds the ordered PostProcessor chain shared by every copy
+// of an MdfStore value. It is allocated once in New and referenced by
+// pointer so that AddProcessor, called on any later copy of the store (e.g.
+// after New has already handed the ConversionQueue its Runner), mutates the
+// same chain the queue actually runs — rather than a snapshot frozen at New
+// time.
+type processorList struct {
+	mu    sync.Mutex
+	procs []PostProcessor
+}
+
+func newProcessorList() *processorList {
+	return &processorList{}
+}
+
+func (l *processorList) add(proc PostProcessor) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.procs = append(l.procs, proc)
+}
+
+func (l *processorList) snapshot() []PostProcessor {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]PostProcessor, len(l.procs))
+	copy(out, l.procs)
+	return out
+}
+
+func (l *processorList) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.procs)
+}
@@ -0,0 +1,106 @@
+package mdfstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/psperber94/tusd"
+)
+
+// waitForConversionStatus polls GetConversionStatus until the upload
+// reaches want or ConversionFailed, or the deadline expires.
+func waitForConversionStatus(t *testing.T, store MdfStore, id string, want ConversionState) ConversionStatus {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status, err := store.GetConversionStatus(id)
+		if err != nil {
+			t.Fatalf("GetConversionStatus(%s): %s", id, err)
+		}
+		if status.State == want || status.State == ConversionFailed {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for upload %s to reach state %s, last status: %+v", id, want, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFinishUploadRunsProcessorChainInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) FuncProcessor {
+		return FuncProcessor{Fn: func(ctx context.Context, id string, binPath string, info tusd.FileInfo) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}}
+	}
+
+	dir, err := ioutil.TempDir("", "mdfstore-test")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	store := New(dir, "", WithProcessor(record("first")), WithProcessor(record("second")))
+	writeTestUpload(t, store, "a", "payload")
+
+	if err := store.FinishUpload("a"); err != nil {
+		t.Fatalf("FinishUpload: %s", err)
+	}
+
+	status := waitForConversionStatus(t, store, "a", ConversionSucceeded)
+	if status.State != ConversionSucceeded {
+		t.Fatalf("status.State = %s, want %s", status.State, ConversionSucceeded)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Fatalf("unexpected processor order: %v", order)
+	}
+}
+
+func TestExecProcessorSubstitutesPlaceholders(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	dir, err := ioutil.TempDir("", "mdfstore-exec-test")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	binPath := filepath.Join(dir, "upload.bin")
+	if err := ioutil.WriteFile(binPath, []byte("payload"), defaultFilePerm); err != nil {
+		t.Fatalf("writing bin file: %s", err)
+	}
+	markerPath := filepath.Join(dir, "marker")
+
+	proc := &ExecProcessor{
+		Command: "/bin/sh",
+		Args:    []string{"-c", fmt.Sprintf("cat %s > %s", "{{bin}}", markerPath)},
+	}
+
+	if err := proc.Process(context.Background(), "upload-id", binPath, tusd.FileInfo{ID: "upload-id"}); err != nil {
+		t.Fatalf("Process: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(markerPath)
+	if err != nil {
+		t.Fatalf("reading marker: %s", err)
+	}
+	if string(data) != "payload" {
+		t.Fatalf("marker content = %q, want %q", data, "payload")
+	}
+}
@@ -0,0 +1,261 @@
+package mdfstore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psperber94/tusd"
+)
+
+// ConversionState describes the lifecycle of a single upload's PostProcessor
+// chain.
+type ConversionState string
+
+const (
+	ConversionPending   ConversionState = "pending"
+	ConversionRunning   ConversionState = "running"
+	ConversionSucceeded ConversionState = "succeeded"
+	ConversionFailed    ConversionState = "failed"
+)
+
+// ConversionStatus is the result returned by GetConversionStatus.
+type ConversionStatus struct {
+	State ConversionState
+	// Err holds the last processor error, set only when State is
+	// ConversionFailed.
+	Err string
+	// Attempts counts how many times the job has been run, including the
+	// current or final attempt.
+	Attempts int
+}
+
+// RetryPolicy configures how a ConversionQueue backs off between failed
+// attempts of the same job.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+// DefaultRetryPolicy is used by New if no Option overrides it.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+}
+
+func (r RetryPolicy) backoff(attempt int) time.Duration {
+	d := r.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		d = time.Duration(float64(d) * r.Multiplier)
+		if r.MaxBackoff > 0 && d > r.MaxBackoff {
+			return r.MaxBackoff
+		}
+	}
+	return d
+}
+
+// Runner executes the PostProcessor chain for a single upload. MdfStore
+// supplies this to a ConversionQueue's Init method.
+type Runner func(ctx context.Context, id string, binPath string, info tusd.FileInfo) error
+
+// UpdateFunc is invoked by a ConversionQueue whenever a job's status
+// changes. MdfStore supplies this to persist the status into the upload's
+// .info file and an in-memory cache.
+type UpdateFunc func(id string, status ConversionStatus)
+
+// ConversionQueue schedules and runs the PostProcessor chain for finished
+// uploads asynchronously, so that FinishUpload can return immediately
+// instead of blocking the tus request on the conversion.
+type ConversionQueue interface {
+	// Init wires the queue up with the function that actually runs the
+	// PostProcessor chain and the callback used to report status changes.
+	// It is called once by New before Recover.
+	Init(runner Runner, update UpdateFunc)
+	// Enqueue schedules id for processing.
+	Enqueue(id string, binPath string, info tusd.FileInfo) error
+	// Recover re-enqueues any jobs that were still pending or running when
+	// the process last stopped. It is called once during MdfStore setup.
+	Recover() error
+}
+
+type conversionJob struct {
+	ID       string
+	BinPath  string
+	Info     tusd.FileInfo
+	Attempts int
+}
+
+// WorkerPoolQueue is the default ConversionQueue backend. It runs jobs on a
+// bounded pool of goroutines entirely in memory; if the process restarts,
+// any job that was pending or running is lost, so Recover is a no-op.
+type WorkerPoolQueue struct {
+	Workers int
+	Retry   RetryPolicy
+
+	runner Runner
+	update UpdateFunc
+	jobs   chan conversionJob
+}
+
+// NewWorkerPoolQueue creates a WorkerPoolQueue with the given number of
+// concurrent workers and retry policy.
+func NewWorkerPoolQueue(workers int, retry RetryPolicy) *WorkerPoolQueue {
+	return &WorkerPoolQueue{Workers: workers, Retry: retry}
+}
+
+func (q *WorkerPoolQueue) Init(runner Runner, update UpdateFunc) {
+	q.runner = runner
+	q.update = update
+	q.jobs = make(chan conversionJob, 64)
+
+	workers := q.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+}
+
+func (q *WorkerPoolQueue) Enqueue(id string, binPath string, info tusd.FileInfo) error {
+	q.update(id, ConversionStatus{State: ConversionPending})
+	q.jobs <- conversionJob{ID: id, BinPath: binPath, Info: info}
+	return nil
+}
+
+// Recover is a no-op: an in-memory queue has nothing left to recover after a
+// restart.
+func (q *WorkerPoolQueue) Recover() error {
+	return nil
+}
+
+func (q *WorkerPoolQueue) work() {
+	for job := range q.jobs {
+		q.run(job)
+	}
+}
+
+func (q *WorkerPoolQueue) run(job conversionJob) {
+	attempt := job.Attempts
+	for {
+		attempt++
+		q.update(job.ID, ConversionStatus{State: ConversionRunning, Attempts: attempt})
+
+		err := q.runner(context.Background(), job.ID, job.BinPath, job.Info)
+		if err == nil {
+			q.update(job.ID, ConversionStatus{State: ConversionSucceeded, Attempts: attempt})
+			return
+		}
+
+		if attempt >= q.Retry.MaxAttempts {
+			q.update(job.ID, ConversionStatus{State: ConversionFailed, Err: err.Error(), Attempts: attempt})
+			return
+		}
+
+		time.Sleep(q.Retry.backoff(attempt))
+	}
+}
+
+// DiskQueue wraps another ConversionQueue and additionally persists a
+// "{id}.job" marker file next to the upload's .bin/.info files for every
+// pending job, so that Recover can re-enqueue work that was still
+// outstanding when the process last stopped.
+type DiskQueue struct {
+	Path  string
+	Inner ConversionQueue
+}
+
+// NewDiskQueue wraps inner with job-file persistence rooted at path, which
+// should be the same directory as the MdfStore's Path.
+func NewDiskQueue(path string, inner ConversionQueue) *DiskQueue {
+	return &DiskQueue{Path: path, Inner: inner}
+}
+
+func (q *DiskQueue) jobPath(id string) string {
+	return filepath.Join(q.Path, id+".job")
+}
+
+func (q *DiskQueue) Init(runner Runner, update UpdateFunc) {
+	wrapped := func(id string, status ConversionStatus) {
+		if status.State == ConversionSucceeded || status.State == ConversionFailed {
+			os.Remove(q.jobPath(id))
+		}
+		update(id, status)
+	}
+	q.Inner.Init(runner, wrapped)
+}
+
+func (q *DiskQueue) Enqueue(id string, binPath string, info tusd.FileInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(q.jobPath(id), data, defaultFilePerm); err != nil {
+		return err
+	}
+	return q.Inner.Enqueue(id, binPath, info)
+}
+
+func (q *DiskQueue) Recover() error {
+	entries, err := ioutil.ReadDir(q.Path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".job") {
+			continue
+		}
+
+		id := strings.TrimSuffix(entry.Name(), ".job")
+		data, err := ioutil.ReadFile(q.jobPath(id))
+		if err != nil {
+			return err
+		}
+
+		var info tusd.FileInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return err
+		}
+
+		if err := q.Inner.Enqueue(id, filepath.Join(q.Path, id+".bin"), info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statusTracker holds the in-memory conversion status cache shared by all
+// copies of an MdfStore value. It is allocated once in New and referenced
+// by pointer so that copying an MdfStore never duplicates its lock.
+type statusTracker struct {
+	mu     sync.Mutex
+	status map[string]ConversionStatus
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{status: make(map[string]ConversionStatus)}
+}
+
+func (t *statusTracker) set(id string, status ConversionStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status[id] = status
+}
+
+func (t *statusTracker) get(id string) (ConversionStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status, ok := t.status[id]
+	return status, ok
+}
@@ -0,0 +1,187 @@
+package mdfstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/psperber94/tusd"
+)
+
+// TestFinishUploadPicksUpProcessorAddedAfterNew is a regression test: the
+// queue's Runner must see processors registered via AddProcessor after New
+// has already wired up the ConversionQueue, not just the ones present at
+// New time.
+func TestFinishUploadPicksUpProcessorAddedAfterNew(t *testing.T) {
+	store := newTestStore(t)
+	writeTestUpload(t, store, "a", "payload")
+
+	var ran int32
+	store.AddProcessor(FuncProcessor{Fn: func(ctx context.Context, id string, binPath string, info tusd.FileInfo) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	}})
+
+	if err := store.FinishUpload("a"); err != nil {
+		t.Fatalf("FinishUpload: %s", err)
+	}
+
+	status := waitForConversionStatus(t, store, "a", ConversionSucceeded)
+	if status.State != ConversionSucceeded {
+		t.Fatalf("status = %+v, want %s", status, ConversionSucceeded)
+	}
+	if atomic.LoadInt32(&ran) != 1 {
+		t.Fatalf("processor added via AddProcessor after New did not run (ran=%d)", ran)
+	}
+}
+
+func TestWorkerPoolQueueRetriesWithBackoffBeforeFailing(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+
+	runner := func(ctx context.Context, id string, binPath string, info tusd.FileInfo) error {
+		mu.Lock()
+		attempts++
+		n := attempts
+		mu.Unlock()
+		return fmt.Errorf("attempt %d failed", n)
+	}
+
+	var statuses []ConversionStatus
+	update := func(id string, status ConversionStatus) {
+		mu.Lock()
+		statuses = append(statuses, status)
+		mu.Unlock()
+	}
+
+	queue := NewWorkerPoolQueue(1, RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		Multiplier:     2,
+	})
+	queue.Init(runner, update)
+
+	if err := queue.Enqueue("a", "/tmp/a.bin", tusd.FileInfo{ID: "a"}); err != nil {
+		t.Fatalf("Enqueue: %s", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		done := attempts >= 3 && len(statuses) > 0 && statuses[len(statuses)-1].State == ConversionFailed
+		mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the job to exhaust its retries")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Fatalf("attempts = %d, want 3", attempts)
+	}
+	last := statuses[len(statuses)-1]
+	if last.State != ConversionFailed {
+		t.Fatalf("final status.State = %s, want %s", last.State, ConversionFailed)
+	}
+	if last.Attempts != 3 {
+		t.Fatalf("final status.Attempts = %d, want 3", last.Attempts)
+	}
+}
+
+func TestDiskQueueRecoverReenqueuesJobFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdfstore-diskqueue-test")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	info := tusd.FileInfo{ID: "a", Size: 3}
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("marshalling info: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.job"), data, defaultFilePerm); err != nil {
+		t.Fatalf("writing stale job file: %s", err)
+	}
+
+	var mu sync.Mutex
+	var recovered []string
+	var completed bool
+	runner := func(ctx context.Context, id string, binPath string, info tusd.FileInfo) error {
+		mu.Lock()
+		recovered = append(recovered, id)
+		mu.Unlock()
+		return nil
+	}
+
+	queue := NewDiskQueue(dir, NewWorkerPoolQueue(1, DefaultRetryPolicy))
+	queue.Init(runner, func(id string, status ConversionStatus) {
+		if status.State == ConversionSucceeded {
+			mu.Lock()
+			completed = true
+			mu.Unlock()
+		}
+	})
+
+	if err := queue.Recover(); err != nil {
+		t.Fatalf("Recover: %s", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(recovered)
+		done := completed
+		mu.Unlock()
+		if n == 1 && done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the recovered job to run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a.job")); !os.IsNotExist(err) {
+		t.Fatalf("expected a.job to be removed once the recovered job completed, stat err = %v", err)
+	}
+}
+
+// TestGetConversionStatusFallsBackToPersistedInfo covers a fresh MdfStore
+// pointed at a directory whose .info already has a conversion_state, e.g.
+// after a process restart where the in-memory status cache is empty.
+func TestGetConversionStatusFallsBackToPersistedInfo(t *testing.T) {
+	store := newTestStore(t)
+	writeTestUpload(t, store, "a", "payload")
+
+	info, err := store.GetInfo("a")
+	if err != nil {
+		t.Fatalf("GetInfo: %s", err)
+	}
+	info.MetaData = tusd.MetaData{"conversion_state": string(ConversionFailed), "conversion_error": "boom"}
+	if err := store.writeInfo("a", info); err != nil {
+		t.Fatalf("writeInfo: %s", err)
+	}
+
+	fresh := New(store.Path, "")
+	status, err := fresh.GetConversionStatus("a")
+	if err != nil {
+		t.Fatalf("GetConversionStatus: %s", err)
+	}
+	if status.State != ConversionFailed || status.Err != "boom" {
+		t.Fatalf("status = %+v, want {State:Failed Err:boom}", status)
+	}
+}